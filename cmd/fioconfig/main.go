@@ -0,0 +1,70 @@
+// Command fioconfig is the on-device CLI for LAN pairing. Its only
+// subcommand, pair, either offers this device's config.encrypted to a
+// peer on the LAN (serve) or fetches it from one and extracts its
+// secrets (fetch); it does not check in with the Foundries server.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/foundries-io/fioconfig/internal"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: fioconfig pair serve|fetch <sota-dir> <secrets-dir> [connection-string]")
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "pair" {
+		usage()
+	}
+	pair(os.Args[2:])
+}
+
+func pair(args []string) {
+	if len(args) < 3 {
+		usage()
+	}
+	mode, sotaConfig, secretsDir := args[0], args[1], args[2]
+
+	app, err := internal.NewApp(sotaConfig, secretsDir, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	switch mode {
+	case "serve":
+		connStr, done, err := app.ServeLAN(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(connStr)
+		// Block until a peer has paired (or ctx is cancelled), so the
+		// process sticks around long enough for the pairing to happen
+		// instead of exiting the instant the connection string is printed.
+		if err := <-done; err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "fetch":
+		if len(args) < 4 {
+			usage()
+		}
+		if err := app.FetchLAN(ctx, args[3]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,12 +13,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/crypto/ecies"
+
+	"github.com/foundries-io/fioconfig/internal/certrotate"
+	"github.com/foundries-io/fioconfig/internal/lanpair"
 )
 
 var NotModifiedError = errors.New("Config unchanged on server")
@@ -27,8 +33,22 @@ type App struct {
 	EncryptedConfig string
 	SecretsDir      string
 
-	client    *http.Client
-	configUrl string
+	// client is swapped out by reloadClient whenever the mTLS identity
+	// rotates, which can happen on a separate timer (WatchCertRotation)
+	// concurrently with a CheckIn in progress, so it's read and written
+	// through an atomic.Pointer rather than a plain field.
+	client     atomic.Pointer[http.Client]
+	configUrl  string
+	sotaConfig string
+	certRotate *certrotate.Rotator
+}
+
+func (a *App) getClient() *http.Client {
+	return a.client.Load()
+}
+
+func (a *App) setClient(client *http.Client) {
+	a.client.Store(client)
 }
 
 func createClient(sota_config string) (*http.Client, *ecdsa.PrivateKey) {
@@ -59,6 +79,23 @@ func createClient(sota_config string) (*http.Client, *ecdsa.PrivateKey) {
 func NewApp(sota_config, secrets_dir string, testing bool) (*App, error) {
 	var client *http.Client
 	var priv *ecdsa.PrivateKey
+
+	configUrl := os.Getenv("CONFIG_URL")
+	if len(configUrl) == 0 {
+		configUrl = "https://ota-lite.foundries.io:8443/config"
+	}
+
+	var certRotate *certrotate.Rotator
+	if !testing {
+		certRotate = certrotate.New(sota_config, renewUrl(configUrl))
+		// Recover must run before anything tries to load client.pem/
+		// pkey.pem, so a rotation interrupted by a crash is repaired
+		// instead of permanently bricking the device's mTLS identity.
+		if err := certRotate.Recover(); err != nil {
+			return nil, fmt.Errorf("Unable to start: %w", err)
+		}
+	}
+
 	if testing {
 		path := filepath.Join(sota_config, "pkey.pem")
 		pkey_pem, err := ioutil.ReadFile(path)
@@ -80,21 +117,51 @@ func NewApp(sota_config, secrets_dir string, testing bool) (*App, error) {
 		client, priv = createClient(sota_config)
 	}
 
-	url := os.Getenv("CONFIG_URL")
-	if len(url) == 0 {
-		url = "https://ota-lite.foundries.io:8443/config"
-	}
 	app := App{
 		PrivKey:         ecies.ImportECDSA(priv),
 		EncryptedConfig: filepath.Join(sota_config, "config.encrypted"),
 		SecretsDir:      secrets_dir,
-		client:          client,
-		configUrl:       url,
+		configUrl:       configUrl,
+		sotaConfig:      sota_config,
+		certRotate:      certRotate,
+	}
+	app.setClient(client)
+
+	if !testing {
+		if err := app.certRotate.CheckRevoked(); err != nil {
+			return nil, fmt.Errorf("Unable to start: %w", err)
+		}
 	}
 
 	return &app, nil
 }
 
+// renewUrl derives the mTLS cert rotation endpoint from the config URL,
+// e.g. https://ota-lite.foundries.io:8443/config -> .../device/renew.
+func renewUrl(configUrl string) string {
+	return deviceUrl(configUrl, "/device/renew")
+}
+
+// revokeUrl derives the mTLS cert revocation endpoint from the config URL.
+func revokeUrl(configUrl string) string {
+	return deviceUrl(configUrl, "/device/revoke")
+}
+
+// revokedListUrl derives the endpoint used to refresh the cached
+// revocation list CheckRevoked consults.
+func revokedListUrl(configUrl string) string {
+	return deviceUrl(configUrl, "/device/revoked")
+}
+
+func deviceUrl(configUrl, path string) string {
+	u, err := url.Parse(configUrl)
+	if err != nil {
+		return configUrl
+	}
+	u.Path = path
+	return u.String()
+}
+
 // Do an atomic update of the file if needed
 func updateSecret(secretFile string, newContent []byte) (bool, error) {
 	curContent, err := ioutil.ReadFile(secretFile)
@@ -122,6 +189,24 @@ func (a *App) Extract() error {
 
 	for fname, cfgFile := range config {
 		log.Printf("Extracting %s", fname)
+		if tmpl, ok := parseCSRTemplate(cfgFile.Value); ok {
+			renewed, err := a.resolveCSREntry(fname, tmpl)
+			if err != nil {
+				return err
+			}
+			if renewed && len(cfgFile.OnChanged) > 0 {
+				log.Printf("Running on-change command for %s: %v", fname, cfgFile.OnChanged)
+				cmd := exec.Command(cfgFile.OnChanged[0], cfgFile.OnChanged[1:]...)
+				cmd.Env = append(os.Environ(), "CONFIG_FILE="+filepath.Join(a.SecretsDir, fname))
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				if err := cmd.Run(); err != nil {
+					log.Printf("Unable to run command: %v", err)
+				}
+			}
+			continue
+		}
+
 		fullpath := filepath.Join(a.SecretsDir, fname)
 		changed, err := updateSecret(fullpath, []byte(cfgFile.Value))
 		if err != nil {
@@ -176,7 +261,122 @@ func safeWrite(input io.ReadCloser, path string, modtime time.Time) error {
 	return nil
 }
 
+// reloadClient rebuilds the http.Client from whatever client.pem/pkey.pem
+// currently sit in the sota_config directory, without restarting the
+// process.
+func (a *App) reloadClient() error {
+	tlsConfig, err := a.certRotate.NewTLSConfig()
+	if err != nil {
+		return err
+	}
+	a.setClient(&http.Client{Timeout: time.Second * 30, Transport: &http.Transport{TLSClientConfig: tlsConfig}})
+	return nil
+}
+
+// rotateCert renews the client's mTLS identity if it's close to expiry
+// and reloads the http.Client to use it, without restarting the process.
+func (a *App) rotateCert() (bool, error) {
+	if a.certRotate == nil {
+		return false, nil
+	}
+	rotated, err := a.certRotate.Rotate(a.getClient())
+	if err != nil {
+		return false, fmt.Errorf("Unable to rotate client certificate: %w", err)
+	}
+	if !rotated {
+		return false, nil
+	}
+	if err := a.reloadClient(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Revoke submits a revocation request for the device's current client
+// certificate over the mTLS client; the request body is not signed.
+func (a *App) Revoke(reason string) error {
+	if a.certRotate == nil {
+		return fmt.Errorf("Certificate rotation is not enabled")
+	}
+	return a.certRotate.Revoke(a.getClient(), revokeUrl(a.configUrl), reason)
+}
+
+// WatchCertRotation periodically checks whether the client certificate
+// needs rotating, independent of CheckIn, so a long-running process
+// doesn't have to wait for its next scheduled check-in to pick up a
+// renewal that's coming up soon. It blocks until ctx is done, or returns
+// at once if rotation is disabled or interval is not positive.
+func (a *App) WatchCertRotation(ctx context.Context, interval time.Duration) {
+	if a.certRotate == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := a.rotateCert(); err != nil {
+				log.Printf("Unable to rotate client certificate: %s", err)
+			}
+		}
+	}
+}
+
 func (a *App) CheckIn() error {
+	rotated, err := a.rotateCert()
+	if err != nil {
+		return err
+	}
+
+	err = a.checkIn()
+	// NotModifiedError just means the config on the server hasn't changed
+	// since our last fetch; it can only be returned once the mTLS
+	// handshake with the (possibly just-rotated) certificate has already
+	// succeeded, so it's proof the new certificate works, not a failure.
+	if err != nil && !errors.Is(err, NotModifiedError) {
+		if rotated {
+			log.Printf("CheckIn with rotated certificate failed, rolling back: %s", err)
+			if rbErr := a.certRotate.Rollback(); rbErr != nil {
+				log.Printf("Unable to roll back client certificate: %s", rbErr)
+			} else if rlErr := a.reloadClient(); rlErr != nil {
+				log.Printf("Unable to reload rolled-back certificate: %s", rlErr)
+			}
+		}
+		return err
+	}
+	if rotated {
+		a.certRotate.Confirm()
+	}
+	return err
+}
+
+// ServeLAN offers this device's current config.encrypted to a peer on
+// the same LAN, for use when the Foundries server is unreachable. It
+// returns a connection string the peer can pass to FetchLAN - safe to
+// print in a terminal or render as a QR code - along with a channel
+// that receives the pairing attempt's outcome (nil on success) once a
+// peer has connected and the transfer has finished or ctx is done.
+func (a *App) ServeLAN(ctx context.Context) (string, <-chan error, error) {
+	return lanpair.Serve(ctx, a.EncryptedConfig)
+}
+
+// FetchLAN pulls a config.encrypted blob from a peer identified by a
+// connection string produced by ServeLAN, then runs it through the same
+// safeWrite + Extract path CheckIn uses.
+func (a *App) FetchLAN(ctx context.Context, connStr string) error {
+	data, err := lanpair.Fetch(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	if err := safeWrite(ioutil.NopCloser(bytes.NewReader(data)), a.EncryptedConfig, time.Now()); err != nil {
+		return err
+	}
+	return a.Extract()
+}
+
+func (a *App) checkIn() error {
 	req, err := http.NewRequest("GET", a.configUrl, nil)
 	if err != nil {
 		return err
@@ -189,7 +389,7 @@ func (a *App) CheckIn() error {
 		req.Header.Add("If-Modified-Since", ts)
 	}
 
-	res, err := a.client.Do(req)
+	res, err := a.getClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("Unable to get: %s - %v", a.configUrl, err)
 	}
@@ -213,5 +413,12 @@ func (a *App) CheckIn() error {
 		res.Body.Close()
 		return fmt.Errorf("Unable to get %s - HTTP_%d: %s", a.configUrl, res.StatusCode, string(msg))
 	}
+
+	if a.certRotate != nil {
+		if err := a.certRotate.RefreshRevocationList(a.getClient(), revokedListUrl(a.configUrl)); err != nil {
+			log.Printf("Unable to refresh certificate revocation list: %s", err)
+		}
+	}
+
 	return a.Extract()
 }
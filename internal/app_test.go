@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundries-io/fioconfig/internal/certrotate"
+)
+
+// checkInTestCA is an in-process CA used to issue both the device's
+// initial, soon-to-expire identity and the renewed one a fake server
+// hands back during rotation.
+type checkInTestCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCheckInTestCA(t *testing.T) *checkInTestCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &checkInTestCA{cert: cert, key: key}
+}
+
+func (ca *checkInTestCA) issue(t *testing.T, serial int64, notAfter time.Time, pub *ecdsa.PublicKey) []byte {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func writeCheckInIdentity(t *testing.T, ca *checkInTestCA, dir string, serial int64, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := ca.issue(t, serial, notAfter, &key.PublicKey)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.pem"), certPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkey.pem"), keyPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "root.crt"), caPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCheckInConfirmsRotationOn304 exercises the common case where a
+// rotation happens to land on a check-in that finds the config
+// unchanged: a 304 can only be returned after the mTLS handshake with
+// the newly-rotated certificate has already succeeded, so it must
+// Confirm the rotation rather than roll it back.
+func TestCheckInConfirmsRotationOn304(t *testing.T) {
+	sotaDir := t.TempDir()
+	ca := newCheckInTestCA(t)
+	writeCheckInIdentity(t, ca, sotaDir, 2, time.Now().Add(time.Minute))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/renew", func(w http.ResponseWriter, req *http.Request) {
+		csrPEM, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(csrPEM)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(ca.issue(t, 9, time.Now().Add(30*24*time.Hour), csr.PublicKey.(*ecdsa.PublicKey)))
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := &App{
+		EncryptedConfig: filepath.Join(sotaDir, "config.encrypted"),
+		configUrl:       srv.URL + "/config",
+		sotaConfig:      sotaDir,
+		certRotate:      certrotate.New(sotaDir, srv.URL+"/device/renew"),
+	}
+	a.setClient(srv.Client())
+
+	err := a.CheckIn()
+	if err == nil || err.Error() != NotModifiedError.Error() {
+		t.Fatalf("expected NotModifiedError, got %v", err)
+	}
+
+	for _, name := range []string{"client.pem", "pkey.pem"} {
+		if _, statErr := ioutil.ReadFile(filepath.Join(sotaDir, name+".bak")); statErr == nil {
+			t.Fatalf("expected Confirm to remove %s.bak, but it still exists", name)
+		}
+	}
+
+	pair, loadErr := ioutil.ReadFile(filepath.Join(sotaDir, "client.pem"))
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	block, _ := pem.Decode(pair)
+	parsed, parseErr := x509.ParseCertificate(block.Bytes)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if parsed.SerialNumber.Int64() != 9 {
+		t.Fatalf("expected the rotated certificate (serial 9) to remain installed, got serial %d", parsed.SerialNumber.Int64())
+	}
+}
+
+// TestCheckInRollsBackOnRealFailure confirms the existing rollback
+// behavior still triggers for a genuine check-in failure (as opposed to
+// the benign NotModifiedError case above).
+func TestCheckInRollsBackOnRealFailure(t *testing.T) {
+	sotaDir := t.TempDir()
+	ca := newCheckInTestCA(t)
+	writeCheckInIdentity(t, ca, sotaDir, 2, time.Now().Add(time.Minute))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/renew", func(w http.ResponseWriter, req *http.Request) {
+		csrPEM, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(csrPEM)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(ca.issue(t, 9, time.Now().Add(30*24*time.Hour), csr.PublicKey.(*ecdsa.PublicKey)))
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "server error")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := &App{
+		EncryptedConfig: filepath.Join(sotaDir, "config.encrypted"),
+		configUrl:       srv.URL + "/config",
+		sotaConfig:      sotaDir,
+		certRotate:      certrotate.New(sotaDir, srv.URL+"/device/renew"),
+	}
+	a.setClient(srv.Client())
+
+	if err := a.CheckIn(); err == nil {
+		t.Fatal("expected a 500 response to be treated as a failure")
+	}
+
+	pair, err := ioutil.ReadFile(filepath.Join(sotaDir, "client.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pair)
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected the rotation to be rolled back to serial 2, got serial %d", parsed.SerialNumber.Int64())
+	}
+}
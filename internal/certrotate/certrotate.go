@@ -0,0 +1,329 @@
+// Package certrotate manages the lifecycle of a device's mTLS client
+// identity, renewing the leaf certificate before it expires and refusing
+// to start if the identity has been revoked - the same role an ACME
+// client plays for a leaf certificate.
+package certrotate
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrRevoked is returned by CheckRevoked when the device's current
+// client certificate appears in the cached revocation list.
+var ErrRevoked = errors.New("local certificate is in the cached revocation list")
+
+// Rotator tracks and renews the mTLS client identity stored in a
+// sota_config directory (client.pem / pkey.pem / root.crt).
+type Rotator struct {
+	SotaConfig string
+	RenewURL   string
+
+	// RenewBefore is how long before NotAfter a renewal is attempted.
+	// If zero, it defaults to 1/3 of the certificate's total lifetime.
+	RenewBefore time.Duration
+}
+
+func New(sotaConfig, renewURL string) *Rotator {
+	return &Rotator{SotaConfig: sotaConfig, RenewURL: renewURL}
+}
+
+func (r *Rotator) certFile() string    { return filepath.Join(r.SotaConfig, "client.pem") }
+func (r *Rotator) keyFile() string     { return filepath.Join(r.SotaConfig, "pkey.pem") }
+func (r *Rotator) caFile() string      { return filepath.Join(r.SotaConfig, "root.crt") }
+func (r *Rotator) revokedFile() string { return filepath.Join(r.SotaConfig, "revoked.json") }
+
+func (r *Rotator) loadCurrent() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(r.certFile(), r.keyFile())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to load client identity: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse client.pem: %w", err)
+	}
+	return cert, pair.PrivateKey.(*ecdsa.PrivateKey), nil
+}
+
+// CheckRevoked refuses to let the device start if its current client
+// certificate's serial number appears in the cached revocation list.
+// A missing revocation list is not an error.
+func (r *Rotator) CheckRevoked() error {
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(r.revokedFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read revocation list: %w", err)
+	}
+	var serials []string
+	if err := json.Unmarshal(raw, &serials); err != nil {
+		return fmt.Errorf("Unable to parse revocation list(%s): %w", r.revokedFile(), err)
+	}
+	for _, s := range serials {
+		if s == cert.SerialNumber.String() {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+// NeedsRenewal reports whether the current client certificate is close
+// enough to expiry that it should be rotated.
+func (r *Rotator) NeedsRenewal() (bool, error) {
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		return false, err
+	}
+	renewBefore := r.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = cert.NotAfter.Sub(cert.NotBefore) / 3
+	}
+	return time.Until(cert.NotAfter) < renewBefore, nil
+}
+
+// Rotate generates a fresh ECDSA P-256 identity, submits a CSR for it
+// over the existing mTLS client, and atomically installs the returned
+// certificate chain. The previous client.pem/pkey.pem pair is kept as
+// *.bak so Rollback can restore it if the new identity turns out to be
+// unusable. It returns false, nil if no renewal was necessary.
+func (r *Rotator) Rotate(client *http.Client) (bool, error) {
+	need, err := r.NeedsRenewal()
+	if err != nil {
+		return false, err
+	}
+	if !need {
+		return false, nil
+	}
+
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Client certificate expires %s, rotating identity", cert.NotAfter)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, fmt.Errorf("Unable to generate rotation key: %w", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  cert.Subject,
+		DNSNames: cert.DNSNames,
+	}, newKey)
+	if err != nil {
+		return false, fmt.Errorf("Unable to create CSR: %w", err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	res, err := client.Post(r.RenewURL, "application/x-pem-file", bytes.NewReader(csrPEM))
+	if err != nil {
+		return false, fmt.Errorf("Unable to reach %s: %w", r.RenewURL, err)
+	}
+	defer res.Body.Close()
+	newCertPEM, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read rotation response: %w", err)
+	}
+	if res.StatusCode != 200 {
+		return false, fmt.Errorf("Unable to renew certificate - HTTP_%d: %s", res.StatusCode, string(newCertPEM))
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(newKey)
+	if err != nil {
+		return false, fmt.Errorf("Unable to marshal rotation key: %w", err)
+	}
+	newKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	// Stage both files before installing either one, so the only thing
+	// that can fail after we start touching the live key/cert is the
+	// second rename - and that path rolls the first one back, so a
+	// reader (including this process on its next start) never finds a
+	// key that doesn't match its cert.
+	if err := r.stage(r.keyFile(), newKeyPEM); err != nil {
+		return false, err
+	}
+	if err := r.stage(r.certFile(), newCertPEM); err != nil {
+		return false, err
+	}
+	if err := r.install(r.keyFile()); err != nil {
+		return false, err
+	}
+	if err := r.install(r.certFile()); err != nil {
+		if rbErr := r.Rollback(); rbErr != nil {
+			log.Printf("Unable to roll back partially-rotated identity: %s", rbErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// stage fsyncs content to path.new, ready for install to rename into
+// place.
+func (r *Rotator) stage(path string, content []byte) error {
+	newPath := path + ".new"
+	f, err := os.OpenFile(newPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s: %w", newPath, err)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to write %s: %w", newPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to fsync %s: %w", newPath, err)
+	}
+	return f.Close()
+}
+
+// install backs up path (if it exists) to path.bak and renames the
+// staged path.new over it.
+func (r *Rotator) install(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return fmt.Errorf("Unable to back up %s: %w", path, err)
+		}
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		return fmt.Errorf("Unable to install %s: %w", path, err)
+	}
+	return nil
+}
+
+// Rollback restores client.pem/pkey.pem from the *.bak files left by the
+// last Rotate, for use when the new identity fails its first CheckIn.
+func (r *Rotator) Rollback() error {
+	for _, path := range []string{r.certFile(), r.keyFile()} {
+		bak := path + ".bak"
+		if _, err := os.Stat(bak); err != nil {
+			continue
+		}
+		if err := os.Rename(bak, path); err != nil {
+			return fmt.Errorf("Unable to roll back %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Confirm discards the backup pair left by the last Rotate, once the new
+// identity has proven itself with a successful CheckIn.
+func (r *Rotator) Confirm() {
+	for _, path := range []string{r.certFile(), r.keyFile()} {
+		os.Remove(path + ".bak")
+	}
+}
+
+// Recover detects a Rotate that was interrupted between installing the
+// new key and installing the new cert (process killed, disk full, etc)
+// and restores the previous, known-good pair from *.bak. It must run
+// before anything tries to load client.pem/pkey.pem, so that a crash
+// mid-rotation self-heals on the next start instead of permanently
+// bricking the device's mTLS identity.
+func (r *Rotator) Recover() error {
+	_, certBakErr := os.Stat(r.certFile() + ".bak")
+	_, keyBakErr := os.Stat(r.keyFile() + ".bak")
+	if certBakErr != nil && keyBakErr != nil {
+		return nil
+	}
+	if _, _, err := r.loadCurrent(); err == nil {
+		// A previous Rotate finished but wasn't Confirmed yet; the
+		// current pair is valid, so there's nothing to recover.
+		return nil
+	}
+	log.Printf("Detected an interrupted certificate rotation, restoring previous identity")
+	return r.Rollback()
+}
+
+// NewTLSConfig reloads client.pem/pkey.pem/root.crt from disk, for use
+// after Rotate has installed a new identity without restarting the
+// process.
+func (r *Rotator) NewTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile(), r.keyFile())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load client identity: %w", err)
+	}
+	caCert, err := ioutil.ReadFile(r.caFile())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", r.caFile(), err)
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: caCertPool}, nil
+}
+
+// RefreshRevocationList fetches the current list of revoked serial
+// numbers from revokedURL and caches it to revoked.json, so CheckRevoked
+// has up-to-date data to consult even if the device is later unable to
+// reach the server at all.
+func (r *Rotator) RefreshRevocationList(client *http.Client, revokedURL string) error {
+	res, err := client.Get(revokedURL)
+	if err != nil {
+		return fmt.Errorf("Unable to reach %s: %w", revokedURL, err)
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read revocation list response: %w", err)
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Unable to fetch revocation list - HTTP_%d: %s", res.StatusCode, string(raw))
+	}
+	var serials []string
+	if err := json.Unmarshal(raw, &serials); err != nil {
+		return fmt.Errorf("Unable to parse revocation list: %w", err)
+	}
+	tmp := r.revokedFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0640); err != nil {
+		return fmt.Errorf("Unable to create %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, r.revokedFile()); err != nil {
+		return fmt.Errorf("Unable to update %s: %w", r.revokedFile(), err)
+	}
+	return nil
+}
+
+// Revoke submits a revocation request (the current client certificate's
+// serial number and reason, as JSON) to revokeURL. The request body is
+// not signed; it is authenticated only by the mTLS client it is sent
+// over.
+func (r *Rotator) Revoke(client *http.Client, revokeURL, reason string) error {
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(struct {
+		Serial string `json:"serial"`
+		Reason string `json:"reason"`
+	}{cert.SerialNumber.String(), reason})
+	if err != nil {
+		return fmt.Errorf("Unable to encode revocation request: %w", err)
+	}
+	res, err := client.Post(revokeURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to reach %s: %w", revokeURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Unable to revoke certificate - HTTP_%d: %s", res.StatusCode, string(msg))
+	}
+	return nil
+}
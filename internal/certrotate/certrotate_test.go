@@ -0,0 +1,288 @@
+package certrotate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is an in-process certificate authority used to issue both the
+// device's initial identity and renewed ones, so the tests never touch
+// the network.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, notAfter time.Time, pub *ecdsa.PublicKey) []byte {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// writeIdentity generates a fresh client key, has the CA issue it a
+// certificate expiring at notAfter, and writes client.pem/pkey.pem/
+// root.crt into dir.
+func writeIdentity(t *testing.T, ca *testCA, dir string, serial int64, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := ca.issue(t, serial, notAfter, &key.PublicKey)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.pem"), certPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkey.pem"), keyPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "root.crt"), caPEM, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	writeIdentity(t, ca, dir, 2, time.Now().Add(30*24*time.Hour))
+	r := New(dir, "")
+	need, err := r.NeedsRenewal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if need {
+		t.Fatal("expected a freshly issued certificate to not need renewal")
+	}
+
+	writeIdentity(t, ca, dir, 3, time.Now().Add(time.Minute))
+	need, err = r.NeedsRenewal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !need {
+		t.Fatal("expected a soon-to-expire certificate to need renewal")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeIdentity(t, ca, dir, 2, time.Now().Add(time.Minute))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		csrPEM, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(csrPEM)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPEM := ca.issue(t, 4, time.Now().Add(30*24*time.Hour), csr.PublicKey.(*ecdsa.PublicKey))
+		w.Write(certPEM)
+	}))
+	defer srv.Close()
+
+	r := New(dir, srv.URL)
+	rotated, err := r.Rotate(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("expected rotation to occur for a soon-to-expire certificate")
+	}
+
+	for _, name := range []string{"client.pem", "pkey.pem"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".bak")); err != nil {
+			t.Fatalf("expected %s.bak to exist after rotation: %s", name, err)
+		}
+	}
+
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Int64() != 4 {
+		t.Fatalf("expected the rotated certificate to be serial 4, got %d", cert.SerialNumber.Int64())
+	}
+
+	again, err := r.Rotate(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again {
+		t.Fatal("expected no further rotation once the new certificate is long-lived")
+	}
+
+	r.Confirm()
+	for _, name := range []string{"client.pem", "pkey.pem"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".bak")); !os.IsNotExist(err) {
+			t.Fatalf("expected Confirm to remove %s.bak", name)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeIdentity(t, ca, dir, 2, time.Now().Add(time.Minute))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		block, _ := pem.Decode(mustRead(t, req))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(ca.issue(t, 9, time.Now().Add(30*24*time.Hour), csr.PublicKey.(*ecdsa.PublicKey)))
+	}))
+	defer srv.Close()
+
+	r := New(dir, srv.URL)
+	if _, err := r.Rotate(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected Rollback to restore serial 2, got %d", cert.SerialNumber.Int64())
+	}
+}
+
+func TestRecoverFromInterruptedRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeIdentity(t, ca, dir, 2, time.Now().Add(30*24*time.Hour))
+
+	// Simulate a Rotate that installed a new key but crashed before the
+	// matching cert was installed: the old pair is backed up as *.bak,
+	// pkey.pem is a new, unrelated key, and client.pem is missing.
+	if err := os.Rename(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.pem.bak")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "pkey.pem"), filepath.Join(dir, "pkey.pem.bak")); err != nil {
+		t.Fatal(err)
+	}
+	writeIdentity(t, ca, dir, 5, time.Now().Add(30*24*time.Hour))
+	if err := os.Remove(filepath.Join(dir, "client.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(dir, "")
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := r.loadCurrent()
+	if err != nil {
+		t.Fatalf("expected Recover to leave a loadable pair: %s", err)
+	}
+	if cert.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected Recover to restore serial 2, got %d", cert.SerialNumber.Int64())
+	}
+}
+
+func TestCheckRevoked(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeIdentity(t, ca, dir, 7, time.Now().Add(30*24*time.Hour))
+
+	r := New(dir, "")
+	if err := r.CheckRevoked(); err != nil {
+		t.Fatalf("expected no revocation list to mean not revoked: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "revoked.json"), []byte(`["7"]`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckRevoked(); err != ErrRevoked {
+		t.Fatalf("expected ErrRevoked, got %v", err)
+	}
+}
+
+func TestRefreshRevocationList(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	writeIdentity(t, ca, dir, 7, time.Now().Add(30*24*time.Hour))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`["7"]`))
+	}))
+	defer srv.Close()
+
+	r := New(dir, "")
+	if err := r.RefreshRevocationList(srv.Client(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckRevoked(); err != ErrRevoked {
+		t.Fatalf("expected the refreshed list to mark the device revoked, got %v", err)
+	}
+}
+
+func mustRead(t *testing.T, req *http.Request) []byte {
+	t.Helper()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// csrTemplate is what a cfgFile.Value looks like when the server wants
+// fioconfig to generate a key on-device instead of shipping a literal
+// secret: {"type": "csr", "key_type": "ec-p256", ...}.
+type csrTemplate struct {
+	Type        string   `json:"type"`
+	KeyType     string   `json:"key_type"`
+	Subject     string   `json:"subject"`
+	SANs        []string `json:"sans"`
+	RenewBefore string   `json:"renew_before"`
+	SubmitURL   string   `json:"submit_url"`
+}
+
+// csrState is the on-disk record of an issued on-device certificate,
+// kept next to config.encrypted so a later Extract run knows when to
+// renew without having to reparse every cert on every run.
+type csrState struct {
+	NotAfter time.Time `json:"not_after"`
+}
+
+func csrStatePath(encryptedConfig, fname string) string {
+	return filepath.Join(filepath.Dir(encryptedConfig), fname+".csrstate.json")
+}
+
+// parseCSRTemplate returns the decoded template and true if value is a
+// CSR request; false (with no error) if it's just an ordinary secret.
+func parseCSRTemplate(value string) (*csrTemplate, bool) {
+	var tmpl csrTemplate
+	if err := json.Unmarshal([]byte(value), &tmpl); err != nil || tmpl.Type != "csr" {
+		return nil, false
+	}
+	return &tmpl, true
+}
+
+func needsCSRRenewal(encryptedConfig, fname string, renewBefore time.Duration) bool {
+	raw, err := ioutil.ReadFile(csrStatePath(encryptedConfig, fname))
+	if err != nil {
+		return true
+	}
+	var state csrState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return true
+	}
+	return time.Until(state.NotAfter) < renewBefore
+}
+
+func saveCSRState(encryptedConfig, fname string, notAfter time.Time) error {
+	raw, err := json.Marshal(csrState{NotAfter: notAfter})
+	if err != nil {
+		return fmt.Errorf("Unable to encode CSR state for %s: %w", fname, err)
+	}
+	return ioutil.WriteFile(csrStatePath(encryptedConfig, fname), raw, 0640)
+}
+
+// generateCSRKey produces a fresh private key of the requested type and
+// returns it alongside its PKCS8-encoded form for writing to disk.
+func generateCSRKey(keyType string) (interface{}, []byte, error) {
+	var key interface{}
+	var err error
+	switch keyType {
+	case "", "ec-p256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa-2048":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, nil, fmt.Errorf("Unsupported key_type: %s", keyType)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to marshal key: %w", err)
+	}
+	return key, der, nil
+}
+
+// resolveCSREntry generates an on-device key pair, signs a CSR against
+// tmpl, submits it over the existing mTLS client, and installs the
+// returned certificate and the locally-generated key into SecretsDir via
+// installKeyCertPair, which swaps the pair into place as a single atomic
+// operation. The private key never appears in config.encrypted and
+// never leaves the device.
+func (a *App) resolveCSREntry(fname string, tmpl *csrTemplate) (bool, error) {
+	renewBefore := 24 * time.Hour
+	if d, err := time.ParseDuration(tmpl.RenewBefore); err == nil {
+		renewBefore = d
+	}
+	if !needsCSRRenewal(a.EncryptedConfig, fname, renewBefore) {
+		return false, nil
+	}
+
+	key, keyDER, err := generateCSRKey(tmpl.KeyType)
+	if err != nil {
+		return false, fmt.Errorf("Unable to generate key for %s: %w", fname, err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: tmpl.Subject},
+		DNSNames: tmpl.SANs,
+	}, key)
+	if err != nil {
+		return false, fmt.Errorf("Unable to create CSR for %s: %w", fname, err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+
+	client := a.getClient()
+	if client == nil {
+		return false, fmt.Errorf("Unable to submit CSR for %s: no mTLS client configured", fname)
+	}
+	res, err := client.Post(tmpl.SubmitURL, "application/x-pem-file", bytes.NewReader(csrPEM))
+	if err != nil {
+		return false, fmt.Errorf("Unable to reach %s: %w", tmpl.SubmitURL, err)
+	}
+	defer res.Body.Close()
+	certPEM, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read CSR response for %s: %w", fname, err)
+	}
+	if res.StatusCode != 200 {
+		return false, fmt.Errorf("Unable to issue certificate for %s - HTTP_%d: %s", fname, res.StatusCode, string(certPEM))
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false, fmt.Errorf("Unable to decode issued certificate for %s", fname)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse issued certificate for %s: %w", fname, err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := installKeyCertPair(a.SecretsDir, fname, keyPEM, certPEM); err != nil {
+		return false, err
+	}
+
+	if err := saveCSRState(a.EncryptedConfig, fname, cert.NotAfter); err != nil {
+		return false, err
+	}
+
+	log.Printf("Issued certificate for %s, expires %s", fname, cert.NotAfter)
+	return true, nil
+}
+
+// installKeyCertPair installs a new key+cert pair for fname such that no
+// reader ever observes one half without the other. It stages the pair
+// with stageKeyCertPair, then makes it visible with activateKeyCertPair;
+// see those for how the invariant is upheld.
+func installKeyCertPair(secretsDir, fname string, keyPEM, certPEM []byte) error {
+	versionDir, err := stageKeyCertPair(secretsDir, fname, keyPEM, certPEM)
+	if err != nil {
+		return err
+	}
+	return activateKeyCertPair(secretsDir, fname, versionDir)
+}
+
+// stageKeyCertPair writes keyPEM and certPEM into a fresh version
+// directory under secretsDir that nothing reads yet - it has no effect
+// on what's currently installed for fname, so it can safely run however
+// long key generation and CSR submission take without exposing readers
+// to a partial update.
+func stageKeyCertPair(secretsDir, fname string, keyPEM, certPEM []byte) (string, error) {
+	versionsDir := filepath.Join(secretsDir, "."+fname+".versions")
+	if err := os.MkdirAll(versionsDir, 0750); err != nil {
+		return "", fmt.Errorf("Unable to create %s: %w", versionsDir, err)
+	}
+
+	versionDir := filepath.Join(versionsDir, fmt.Sprintf("%d", time.Now().UnixNano()))
+	if err := os.Mkdir(versionDir, 0750); err != nil {
+		return "", fmt.Errorf("Unable to create %s: %w", versionDir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "key"), keyPEM, 0640); err != nil {
+		return "", fmt.Errorf("Unable to write %s.key: %w", fname, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "cert"), certPEM, 0640); err != nil {
+		return "", fmt.Errorf("Unable to write %s: %w", fname, err)
+	}
+	return versionDir, nil
+}
+
+// activateKeyCertPair makes versionDir (as staged by stageKeyCertPair)
+// the pair a reader of fname.key/fname sees. Both paths are symlinks
+// into a "current" symlink that itself points at versionDir; the only
+// step that changes what's visible is retargeting "current", which is a
+// single rename, so a reader sees either the fully-old pair or the
+// fully-new one - never a new key next to an old cert or vice versa.
+func activateKeyCertPair(secretsDir, fname, versionDir string) error {
+	versionsDir := filepath.Dir(versionDir)
+	currentLink := filepath.Join(versionsDir, "current")
+	if err := ensureSymlink(filepath.Join(secretsDir, fname+".key"), filepath.Join(currentLink, "key")); err != nil {
+		return err
+	}
+	if err := ensureSymlink(filepath.Join(secretsDir, fname), filepath.Join(currentLink, "cert")); err != nil {
+		return err
+	}
+
+	previous, _ := os.Readlink(currentLink)
+	tmpLink := currentLink + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(versionDir, tmpLink); err != nil {
+		return fmt.Errorf("Unable to stage %s: %w", currentLink, err)
+	}
+	if err := os.Rename(tmpLink, currentLink); err != nil {
+		return fmt.Errorf("Unable to activate %s: %w", currentLink, err)
+	}
+
+	if previous != "" && previous != versionDir {
+		if err := os.RemoveAll(previous); err != nil {
+			log.Printf("Unable to remove superseded %s version %s: %s", fname, previous, err)
+		}
+	}
+	return nil
+}
+
+// ensureSymlink creates a symlink at path pointing at target if path
+// doesn't already exist, and confirms it still does if it does. path is
+// only ever created once per fname, then always resolves to the same
+// "current" indirection, so later renewals never need to touch it.
+func ensureSymlink(path, target string) error {
+	if existing, err := os.Readlink(path); err == nil {
+		if existing == target {
+			return nil
+		}
+		return fmt.Errorf("%s is not managed by the versioned key/cert installer (points to %s, not %s)", path, existing, target)
+	} else if _, statErr := os.Lstat(path); statErr == nil {
+		return fmt.Errorf("%s already exists and is not a symlink", path)
+	}
+	return os.Symlink(target, path)
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerateCSRKey(t *testing.T) {
+	if _, der, err := generateCSRKey("ec-p256"); err != nil || len(der) == 0 {
+		t.Fatalf("ec-p256: got der len %d, err %v", len(der), err)
+	}
+	if _, der, err := generateCSRKey(""); err != nil || len(der) == 0 {
+		t.Fatalf("default key_type: got der len %d, err %v", len(der), err)
+	}
+	if _, der, err := generateCSRKey("rsa-2048"); err != nil || len(der) == 0 {
+		t.Fatalf("rsa-2048: got der len %d, err %v", len(der), err)
+	}
+	if _, _, err := generateCSRKey("rsa-4096"); err == nil {
+		t.Fatal("expected an unsupported key_type to be rejected")
+	}
+}
+
+func TestParseCSRTemplate(t *testing.T) {
+	if _, ok := parseCSRTemplate(`not json`); ok {
+		t.Fatal("expected non-JSON value to not be treated as a CSR template")
+	}
+	if _, ok := parseCSRTemplate(`{"hello":"world"}`); ok {
+		t.Fatal("expected a plain secret value to not be treated as a CSR template")
+	}
+	tmpl, ok := parseCSRTemplate(`{"type":"csr","key_type":"ec-p256","subject":"device.example.com"}`)
+	if !ok {
+		t.Fatal("expected a csr-typed value to be recognized")
+	}
+	if tmpl.Subject != "device.example.com" {
+		t.Fatalf("unexpected subject: %s", tmpl.Subject)
+	}
+}
+
+func TestCSRStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	encryptedConfig := filepath.Join(dir, "config.encrypted")
+
+	if !needsCSRRenewal(encryptedConfig, "cert.pem", time.Hour) {
+		t.Fatal("expected a missing state file to mean renewal is needed")
+	}
+
+	if err := saveCSRState(encryptedConfig, "cert.pem", time.Now().Add(30*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if needsCSRRenewal(encryptedConfig, "cert.pem", time.Hour) {
+		t.Fatal("expected a freshly issued cert to not need renewal")
+	}
+
+	if err := saveCSRState(encryptedConfig, "cert.pem", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !needsCSRRenewal(encryptedConfig, "cert.pem", time.Hour) {
+		t.Fatal("expected a soon-to-expire cert to need renewal")
+	}
+}
+
+func TestResolveCSREntry(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		raw, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(raw)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}))
+	defer srv.Close()
+
+	secretsDir := t.TempDir()
+	sotaDir := t.TempDir()
+	a := &App{
+		SecretsDir:      secretsDir,
+		EncryptedConfig: filepath.Join(sotaDir, "config.encrypted"),
+	}
+	a.setClient(srv.Client())
+	tmpl := &csrTemplate{Type: "csr", KeyType: "ec-p256", Subject: "device.example.com", SubmitURL: srv.URL}
+
+	renewed, err := a.resolveCSREntry("tls", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed {
+		t.Fatal("expected the first call to issue a certificate")
+	}
+
+	keyPath := filepath.Join(secretsDir, "tls.key")
+	certPath := filepath.Join(secretsDir, "tls")
+	if _, err := os.Stat(keyPath); err != nil {
+		t.Fatalf("expected %s to exist: %s", keyPath, err)
+	}
+	if _, err := os.Stat(certPath); err != nil {
+		t.Fatalf("expected %s to exist: %s", certPath, err)
+	}
+
+	renewed, err = a.resolveCSREntry("tls", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed {
+		t.Fatal("expected a freshly issued certificate to not be renewed again immediately")
+	}
+}
+
+// TestInstallKeyCertPairFailureLeavesPairIntact exercises the failure
+// path: if a renewal stages its new version directory but then fails to
+// activate it, the previously installed pair must be left completely
+// untouched - there is no partial-install state to roll back, since
+// installKeyCertPair never makes a new pair visible until its one
+// atomic rename succeeds.
+func TestInstallKeyCertPairFailureLeavesPairIntact(t *testing.T) {
+	secretsDir := t.TempDir()
+	if err := installKeyCertPair(secretsDir, "tls", []byte("old-key"), []byte("old-cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the final activation rename fail: pre-occupy its staging path
+	// with a non-empty directory, so activateKeyCertPair can neither
+	// remove it nor symlink over it.
+	versionsDir := filepath.Join(secretsDir, ".tls.versions")
+	tmpLink := filepath.Join(versionsDir, "current.tmp")
+	if err := os.Mkdir(tmpLink, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpLink, "keep-nonempty"), []byte("x"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installKeyCertPair(secretsDir, "tls", []byte("new-key"), []byte("new-cert")); err == nil {
+		t.Fatal("expected activation to fail when its staging path is occupied")
+	}
+
+	gotKey, err := ioutil.ReadFile(filepath.Join(secretsDir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCert, err := ioutil.ReadFile(filepath.Join(secretsDir, "tls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotKey) != "old-key" || string(gotCert) != "old-cert" {
+		t.Fatalf("expected the existing pair to survive a failed install untouched, got key=%q cert=%q", gotKey, gotCert)
+	}
+}
+
+// TestActivateKeyCertPairSwapIsTheOnlyVisibleChange proves the actual
+// invariant deterministically rather than by racing a reader against a
+// swap and hoping to catch (or not catch) the window: everything up to
+// and including stageKeyCertPair is invisible to a reader of
+// fname.key/fname, and activateKeyCertPair's single rename is what
+// flips both from the old pair to the new one together.
+func TestActivateKeyCertPairSwapIsTheOnlyVisibleChange(t *testing.T) {
+	secretsDir := t.TempDir()
+	keyPath := filepath.Join(secretsDir, "tls.key")
+	certPath := filepath.Join(secretsDir, "tls")
+
+	if err := installKeyCertPair(secretsDir, "tls", []byte("old-key"), []byte("old-cert")); err != nil {
+		t.Fatal(err)
+	}
+
+	versionDir, err := stageKeyCertPair(secretsDir, "tls", []byte("new-key"), []byte("new-cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Staging is complete, but nothing has been activated: readers must
+	// still see the old, fully consistent pair.
+	gotKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotKey) != "old-key" || string(gotCert) != "old-cert" {
+		t.Fatalf("expected the old pair to still be visible before activation, got key=%q cert=%q", gotKey, gotCert)
+	}
+
+	if err := activateKeyCertPair(secretsDir, "tls", versionDir); err != nil {
+		t.Fatal(err)
+	}
+
+	gotKey, err = ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCert, err = ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotKey) != "new-key" || string(gotCert) != "new-cert" {
+		t.Fatalf("expected the new pair to be visible after activation, got key=%q cert=%q", gotKey, gotCert)
+	}
+}
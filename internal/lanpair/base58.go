@@ -0,0 +1,72 @@
+package lanpair
+
+import "math/big"
+
+// Bitcoin-style base58 alphabet: no 0/O/I/l, so connection strings read
+// unambiguously from a terminal or a scan of a low-res QR code.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+	zero := big.NewInt(0)
+	base := big.NewInt(58)
+	num := new(big.Int).SetBytes(data)
+
+	var out []byte
+	mod := new(big.Int)
+	for num.Cmp(zero) > 0 {
+		num.DivMod(num, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	reverse(out)
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	base := big.NewInt(58)
+	num := big.NewInt(0)
+	for _, c := range s {
+		idx := indexOf(base58Alphabet, byte(c))
+		if idx < 0 {
+			return nil, errInvalidBase58(c)
+		}
+		num.Mul(num, base)
+		num.Add(num, big.NewInt(int64(idx)))
+	}
+
+	decoded := num.Bytes()
+	leadingZeros := 0
+	for _, c := range s {
+		if c != rune(base58Alphabet[0]) {
+			break
+		}
+		leadingZeros++
+	}
+	return append(make([]byte, leadingZeros), decoded...), nil
+}
+
+func indexOf(alphabet string, b byte) int {
+	for i := 0; i < len(alphabet); i++ {
+		if alphabet[i] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+type errInvalidBase58 rune
+
+func (e errInvalidBase58) Error() string {
+	return "Invalid base58 character: " + string(rune(e))
+}
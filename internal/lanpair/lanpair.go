@@ -0,0 +1,496 @@
+// Package lanpair lets a device fetch its config.encrypted blob from a
+// peer on the same LAN when the Foundries server is unreachable. A short
+// connection string - compact enough to show in a terminal or QR code -
+// carries everything the two sides need to find each other, pin the
+// server's TLS certificate, and derive a session key.
+package lanpair
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"golang.org/x/crypto/hkdf"
+)
+
+const protocolVersion = 1
+
+// pskLen, sha256.Size and compressedPubKeyLen (below) size the fixed-width
+// binary wire format Encode/Decode use - chosen so a typical one-address
+// connection string lands well under the <=180 char terminal/QR budget.
+const pskLen = 16
+
+var curve = elliptic.P256()
+
+// connStringRoles enumerates the single byte ConnString.Role packs to
+// on the wire. Only "server" is produced today; "client" is reserved.
+var connStringRoles = []string{"server", "client"}
+
+// ConnString is the information a fioconfig pair client needs to find a
+// server on the LAN, pin its TLS certificate, and authenticate the
+// session - encoded as base58 so it's safe to print or put in a QR code.
+type ConnString struct {
+	Version     int
+	Role        string
+	IPs         []string
+	Port        int
+	Fingerprint string // sha256 of the server's TLS cert, hex
+	ECDHPub     string // ephemeral ECDH public key (compressed point), hex
+	PSK         string // one-time pre-shared key, hex
+}
+
+// Encode packs cs into a fixed-width binary layout (version, role,
+// IPv4 addresses, port, fingerprint, compressed ECDH point, PSK) and
+// base58-encodes the raw bytes directly. Earlier versions JSON-marshaled
+// hex-encoded fields before base58-encoding that, which more than
+// doubled the string's length for no benefit; base58-encoding the raw
+// bytes keeps a typical single-address connection string well under
+// 180 characters.
+func Encode(cs ConnString) (string, error) {
+	raw, err := cs.marshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode connection string: %w", err)
+	}
+	return base58Encode(raw), nil
+}
+
+func Decode(s string) (*ConnString, error) {
+	raw, err := base58Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode connection string: %w", err)
+	}
+	var cs ConnString
+	if err := cs.unmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("Unable to parse connection string: %w", err)
+	}
+	return &cs, nil
+}
+
+func (cs ConnString) marshalBinary() ([]byte, error) {
+	if cs.Version != protocolVersion {
+		return nil, fmt.Errorf("Unsupported pairing protocol version: %d", cs.Version)
+	}
+	role := byte(0)
+	for i, r := range connStringRoles {
+		if r == cs.Role {
+			role = byte(i)
+		}
+	}
+	if len(cs.IPs) == 0 || len(cs.IPs) > 255 {
+		return nil, fmt.Errorf("Connection string must carry between 1 and 255 addresses")
+	}
+	if cs.Port <= 0 || cs.Port > 0xffff {
+		return nil, fmt.Errorf("Invalid port: %d", cs.Port)
+	}
+	fingerprint, err := hex.DecodeString(cs.Fingerprint)
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("Fingerprint must be a %d-byte sha256 sum", sha256.Size)
+	}
+	pub, err := hex.DecodeString(cs.ECDHPub)
+	if err != nil || len(pub) != compressedPubKeyLen {
+		return nil, fmt.Errorf("ECDH public key must be a %d-byte compressed point", compressedPubKeyLen)
+	}
+	psk, err := hex.DecodeString(cs.PSK)
+	if err != nil || len(psk) != pskLen {
+		return nil, fmt.Errorf("PSK must be %d bytes", pskLen)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(cs.Version))
+	buf.WriteByte(role)
+	buf.WriteByte(byte(len(cs.IPs)))
+	for _, s := range cs.IPs {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("Connection string addresses must be IPv4: %s", s)
+		}
+		buf.Write(ip)
+	}
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], uint16(cs.Port))
+	buf.Write(portBuf[:])
+	buf.Write(fingerprint)
+	buf.Write(pub)
+	buf.Write(psk)
+	return buf.Bytes(), nil
+}
+
+func (cs *ConnString) unmarshalBinary(raw []byte) error {
+	if len(raw) < 3 {
+		return fmt.Errorf("Connection string is too short")
+	}
+	cs.Version = int(raw[0])
+	if cs.Version != protocolVersion {
+		return fmt.Errorf("Unsupported pairing protocol version: %d", cs.Version)
+	}
+	if int(raw[1]) >= len(connStringRoles) {
+		return fmt.Errorf("Unknown role: %d", raw[1])
+	}
+	cs.Role = connStringRoles[raw[1]]
+	n := int(raw[2])
+	raw = raw[3:]
+	if n == 0 || len(raw) < n*net.IPv4len {
+		return fmt.Errorf("Connection string is truncated")
+	}
+	cs.IPs = make([]string, n)
+	for i := 0; i < n; i++ {
+		cs.IPs[i] = net.IP(raw[i*net.IPv4len : (i+1)*net.IPv4len]).String()
+	}
+	raw = raw[n*net.IPv4len:]
+
+	want := 2 + sha256.Size + compressedPubKeyLen + pskLen
+	if len(raw) != want {
+		return fmt.Errorf("Connection string is truncated")
+	}
+	cs.Port = int(binary.BigEndian.Uint16(raw[:2]))
+	raw = raw[2:]
+	cs.Fingerprint = hex.EncodeToString(raw[:sha256.Size])
+	raw = raw[sha256.Size:]
+	cs.ECDHPub = hex.EncodeToString(raw[:compressedPubKeyLen])
+	raw = raw[compressedPubKeyLen:]
+	cs.PSK = hex.EncodeToString(raw)
+	return nil
+}
+
+// compressedPubKeyLen is the size of a P-256 point in SEC1 compressed
+// form (1 prefix byte + 32-byte X coordinate), half the size of the
+// uncompressed form this package used to embed in the connection string.
+const compressedPubKeyLen = 33
+
+func marshalPub(pub *ecies.PublicKey) []byte {
+	return elliptic.MarshalCompressed(curve, pub.X, pub.Y)
+}
+
+func unmarshalPub(data []byte) (*ecies.PublicKey, error) {
+	x, y := elliptic.UnmarshalCompressed(curve, data)
+	if x == nil {
+		return nil, fmt.Errorf("Invalid public key encoding")
+	}
+	return ecies.ImportECDSAPublic(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}), nil
+}
+
+func localIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to enumerate network interfaces: %w", err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	return ips, nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fioconfig-pair"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// derive mixes the ECDH shared secret with the one-time PSK, so knowing
+// the PSK alone (e.g. by reading it over someone's shoulder) isn't
+// enough without also completing the ECDH exchange. The result seals
+// every frame exchanged after the handshake.
+func derive(shared, psk []byte) ([]byte, error) {
+	h := hkdf.New(sha256.New, shared, psk, []byte("fioconfig-lan-pair"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, fmt.Errorf("Unable to derive session key: %w", err)
+	}
+	return key, nil
+}
+
+func hmacEqual(got, psk []byte) bool {
+	return hmac.Equal(got, psk)
+}
+
+// writeFrame/readFrame use a 4-byte big-endian length prefix so either
+// side of the pairing connection knows exactly how much to read.
+func writeFrame(w io.Writer, data []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > 16*1024*1024 {
+		return nil, fmt.Errorf("Frame too large: %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newAEAD builds the AES-256-GCM cipher used to seal every frame sent
+// after the ECDH + PSK handshake, keyed by derive's output.
+func newAEAD(sessionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create session cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeSealedFrame seals plaintext with a fresh random nonce and sends
+// it as a single frame, nonce prepended to the ciphertext.
+func writeSealedFrame(w io.Writer, aead cipher.AEAD, plaintext []byte) error {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("Unable to generate nonce: %w", err)
+	}
+	return writeFrame(w, aead.Seal(nonce, nonce, plaintext, nil))
+}
+
+func readSealedFrame(r io.Reader, aead cipher.AEAD) ([]byte, error) {
+	data, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Sealed frame is shorter than its nonce")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt frame: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Serve listens on a random TCP port, announces itself on the LAN over
+// mDNS, and streams configPath's contents to the first client that
+// connects, if that client completes the handshake; no further client
+// is accepted either way. It returns the connection string immediately;
+// the transfer and the mDNS announcements both run in the background,
+// and the transfer's outcome (nil on success) is sent to the returned
+// channel once the single pairing attempt completes or ctx is done. The
+// connection string already carries the server's addresses, so a peer
+// that already has it can dial directly without mDNS; the announcement
+// exists for peers that only know to look for "_fioconfig-pair".
+func Serve(ctx context.Context, configPath string) (string, <-chan error, error) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to create pairing TLS certificate: %w", err)
+	}
+
+	ln, err := tls.Listen("tcp", ":0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to listen: %w", err)
+	}
+
+	eph, err := ecies.GenerateKey(rand.Reader, curve, nil)
+	if err != nil {
+		ln.Close()
+		return "", nil, fmt.Errorf("Unable to generate ECDH key: %w", err)
+	}
+	psk := make([]byte, 16)
+	if _, err := rand.Read(psk); err != nil {
+		ln.Close()
+		return "", nil, fmt.Errorf("Unable to generate one-time PSK: %w", err)
+	}
+
+	ips, err := localIPs()
+	if err != nil {
+		ln.Close()
+		return "", nil, err
+	}
+	cs := ConnString{
+		Version:     protocolVersion,
+		Role:        "server",
+		IPs:         ips,
+		Port:        ln.Addr().(*net.TCPAddr).Port,
+		Fingerprint: fingerprint(cert.Certificate[0]),
+		ECDHPub:     hex.EncodeToString(marshalPub(&eph.PublicKey)),
+		PSK:         hex.EncodeToString(psk),
+	}
+	connStr, err := Encode(cs)
+	if err != nil {
+		ln.Close()
+		return "", nil, err
+	}
+
+	go advertise(ctx, ln.Addr().(*net.TCPAddr).Port, ips)
+
+	done := make(chan error, 1)
+	go func() { done <- serveOnce(ctx, ln, eph, psk, configPath) }()
+
+	return connStr, done, nil
+}
+
+// serveOnce accepts a single pairing connection, completes the ECDH +
+// PSK handshake, and streams configPath to the peer.
+func serveOnce(ctx context.Context, ln net.Listener, eph *ecies.PrivateKey, psk []byte, configPath string) error {
+	defer ln.Close()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return fmt.Errorf("No client connected: %w", err)
+	}
+	defer conn.Close()
+
+	peerPubRaw, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("Handshake failed: %w", err)
+	}
+	peerPub, err := unmarshalPub(peerPubRaw)
+	if err != nil {
+		return fmt.Errorf("Bad peer public key: %w", err)
+	}
+	shared, err := eph.GenerateShared(peerPub, 32, 0)
+	if err != nil {
+		return fmt.Errorf("ECDH failed: %w", err)
+	}
+	sessionKey, err := derive(shared, psk)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(sessionKey)
+	if err != nil {
+		return err
+	}
+
+	auth, err := readSealedFrame(conn, aead)
+	if err != nil || !hmacEqual(auth, psk) {
+		return fmt.Errorf("Client failed PSK authentication")
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %w", configPath, err)
+	}
+	if err := writeSealedFrame(conn, aead, data); err != nil {
+		return fmt.Errorf("Unable to send config: %w", err)
+	}
+	return nil
+}
+
+// Fetch dials a peer advertising connStr, pins its TLS certificate by
+// fingerprint, and returns the encrypted config blob it streams back
+// once the ECDH + PSK handshake completes.
+func Fetch(ctx context.Context, connStr string) ([]byte, error) {
+	cs, err := Decode(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(cs.IPs) == 0 {
+		return nil, fmt.Errorf("Connection string has no addresses")
+	}
+	serverPubRaw, err := hex.DecodeString(cs.ECDHPub)
+	if err != nil {
+		return nil, fmt.Errorf("Bad public key in connection string: %w", err)
+	}
+	psk, err := hex.DecodeString(cs.PSK)
+	if err != nil {
+		return nil, fmt.Errorf("Bad PSK in connection string: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("No peer certificate presented")
+			}
+			if fingerprint(state.PeerCertificates[0].Raw) != cs.Fingerprint {
+				return fmt.Errorf("Peer certificate fingerprint does not match connection string")
+			}
+			return nil
+		},
+	}
+
+	dialer := &tls.Dialer{Config: tlsConfig}
+	addr := net.JoinHostPort(cs.IPs[0], fmt.Sprintf("%d", cs.Port))
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	eph, err := ecies.GenerateKey(rand.Reader, curve, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate ECDH key: %w", err)
+	}
+	if err := writeFrame(conn, marshalPub(&eph.PublicKey)); err != nil {
+		return nil, fmt.Errorf("Unable to send handshake: %w", err)
+	}
+
+	serverPub, err := unmarshalPub(serverPubRaw)
+	if err != nil {
+		return nil, fmt.Errorf("Bad server public key: %w", err)
+	}
+	shared, err := eph.GenerateShared(serverPub, 32, 0)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+	sessionKey, err := derive(shared, psk)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeSealedFrame(conn, aead, psk); err != nil {
+		return nil, fmt.Errorf("Unable to authenticate: %w", err)
+	}
+
+	data, err := readSealedFrame(conn, aead)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,153 @@
+package lanpair
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeFetchRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.encrypted")
+	want := []byte("super-secret-config-blob")
+	if err := ioutil.WriteFile(configPath, want, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connStr, done, err := Serve(ctx, configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Fetch(ctx, connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the pairing attempt to succeed, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve's done channel to fire once the peer fetched the config")
+	}
+}
+
+func TestFetchRejectsWrongPSK(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.encrypted")
+	if err := ioutil.WriteFile(configPath, []byte("config"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connStr, done, err := Serve(ctx, configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := Decode(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.PSK = "00112233445566778899aabbccddeeff"[:32]
+	tampered, err := Encode(*cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Fetch(ctx, tampered); err == nil {
+		t.Fatal("expected Fetch with a mismatched PSK to fail")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the server's pairing attempt to fail PSK authentication")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve's done channel to fire after the failed handshake")
+	}
+}
+
+func TestServeDoneOnCancelWithNoPeer(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.encrypted")
+	if err := ioutil.WriteFile(configPath, []byte("config"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done, err := Serve(ctx, configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected cancelling ctx with no peer connected to surface an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve's done channel to fire once ctx was cancelled")
+	}
+}
+
+func TestConnStringEncodeDecode(t *testing.T) {
+	cs := ConnString{
+		Version:     protocolVersion,
+		Role:        "server",
+		IPs:         []string{"192.168.1.5"},
+		Port:        12345,
+		Fingerprint: strings.Repeat("de", sha256.Size),
+		ECDHPub:     strings.Repeat("03", compressedPubKeyLen),
+		PSK:         strings.Repeat("ca", pskLen),
+	}
+	encoded, err := Encode(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decoded, cs) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", *decoded, cs)
+	}
+}
+
+// TestConnStringLength guards the backlog's "<=180 chars typical" budget
+// for a single-address connection string - the original JSON+hex+base58
+// encoding measured at 411 characters for the same field sizes.
+func TestConnStringLength(t *testing.T) {
+	cs := ConnString{
+		Version:     protocolVersion,
+		Role:        "server",
+		IPs:         []string{"192.168.1.5"},
+		Port:        12345,
+		Fingerprint: strings.Repeat("de", sha256.Size),
+		ECDHPub:     strings.Repeat("03", compressedPubKeyLen),
+		PSK:         strings.Repeat("ca", pskLen),
+	}
+	encoded, err := Encode(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) > 180 {
+		t.Fatalf("expected a single-address connection string to be <=180 chars, got %d: %s", len(encoded), encoded)
+	}
+}
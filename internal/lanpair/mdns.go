@@ -0,0 +1,171 @@
+package lanpair
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// mdnsAddr is the standard mDNS multicast group and port (RFC 6762).
+const mdnsAddr = "224.0.0.251:5353"
+
+// mdnsService is the DNS-SD service type a peer browsing the LAN looks
+// for to discover a device in pairing mode.
+const mdnsService = "_fioconfig-pair._tcp.local."
+
+const mdnsTTL = 120 // seconds, RFC 6762 recommends short TTLs for hosts that may change address
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+	// dnsCacheFlush marks a record as the sole owner of its name, per
+	// RFC 6762 10.2 - set on our unshared SRV/A records, not on the PTR.
+	dnsCacheFlush = 0x8000
+)
+
+// advertise periodically multicasts an mDNS announcement for the
+// pairing service on port until ctx is done, so peers browsing for
+// "_fioconfig-pair._tcp.local." on the LAN can discover the server
+// without already knowing its connection string.
+func advertise(ctx context.Context, port int, ips []string) {
+	pkt, err := buildAnnouncement(port, ips)
+	if err != nil {
+		log.Printf("Unable to build mDNS announcement: %s", err)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		log.Printf("Unable to resolve mDNS multicast address: %s", err)
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		log.Printf("Unable to open mDNS socket, pairing will not be discoverable: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.Write(pkt); err != nil {
+			log.Printf("Unable to send mDNS announcement: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildAnnouncement builds an unsolicited mDNS response (RFC 6762 8.3)
+// advertising instance as a mdnsService instance at host:port, with an A
+// record for each of ips. All records are carried as answers rather than
+// split across answer/additional sections; every mDNS stack accepts
+// either layout.
+func buildAnnouncement(port int, ips []string) ([]byte, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses to announce")
+	}
+	instance := fmt.Sprintf("fioconfig-pair-%d.%s", port, mdnsService)
+	host := fmt.Sprintf("fioconfig-pair-%d.local.", port)
+
+	var answers [][]byte
+	ptrRdata, err := encodeName(instance)
+	if err != nil {
+		return nil, err
+	}
+	answers = append(answers, resourceRecord(mdnsService, dnsTypePTR, dnsClassIN, mdnsTTL, ptrRdata))
+
+	srvRdata, err := srvRdata(host, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+	answers = append(answers, resourceRecord(instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, mdnsTTL, srvRdata))
+
+	for _, ip := range ips {
+		v4 := net.ParseIP(ip).To4()
+		if v4 == nil {
+			continue
+		}
+		answers = append(answers, resourceRecord(host, dnsTypeA, dnsClassIN|dnsCacheFlush, mdnsTTL, v4))
+	}
+
+	var pkt []byte
+	pkt = append(pkt, dnsHeader(len(answers))...)
+	for _, a := range answers {
+		pkt = append(pkt, a...)
+	}
+	return pkt, nil
+}
+
+// dnsHeader builds a 12-byte DNS message header for an unsolicited mDNS
+// response: no question, ancount answers, QR and AA set, everything else
+// zero.
+func dnsHeader(ancount int) []byte {
+	hdr := make([]byte, 12)
+	binary.BigEndian.PutUint16(hdr[2:4], 0x8400) // QR=1 (response), AA=1 (authoritative)
+	binary.BigEndian.PutUint16(hdr[6:8], uint16(ancount))
+	return hdr
+}
+
+// resourceRecord encodes a single DNS resource record: NAME, TYPE,
+// CLASS, TTL, RDLENGTH, RDATA.
+func resourceRecord(name string, rrtype, class uint16, ttl uint32, rdata []byte) []byte {
+	encName, err := encodeName(name)
+	if err != nil {
+		// encodeName only fails on malformed input, which all callers here
+		// construct themselves from known-good pieces.
+		panic(err)
+	}
+	rr := make([]byte, 0, len(encName)+10+len(rdata))
+	rr = append(rr, encName...)
+	var typeClassTTL [8]byte
+	binary.BigEndian.PutUint16(typeClassTTL[0:2], rrtype)
+	binary.BigEndian.PutUint16(typeClassTTL[2:4], class)
+	binary.BigEndian.PutUint32(typeClassTTL[4:8], ttl)
+	rr = append(rr, typeClassTTL[:]...)
+	var rdlen [2]byte
+	binary.BigEndian.PutUint16(rdlen[:], uint16(len(rdata)))
+	rr = append(rr, rdlen[:]...)
+	rr = append(rr, rdata...)
+	return rr
+}
+
+// srvRdata encodes an SRV record's RDATA: priority, weight, port, target.
+func srvRdata(target string, port uint16) ([]byte, error) {
+	encTarget, err := encodeName(target)
+	if err != nil {
+		return nil, err
+	}
+	rdata := make([]byte, 0, 6+len(encTarget))
+	rdata = append(rdata, 0, 0, 0, 0) // priority=0, weight=0
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], port)
+	rdata = append(rdata, portBuf[:]...)
+	rdata = append(rdata, encTarget...)
+	return rdata, nil
+}
+
+// encodeName encodes a dot-separated DNS name as length-prefixed labels
+// terminated by a zero-length label, without name compression - simple
+// to get right, at the cost of a few extra bytes per packet that don't
+// matter on a LAN.
+func encodeName(name string) ([]byte, error) {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid DNS label in name %q", name)
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0), nil
+}
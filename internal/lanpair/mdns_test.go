@@ -0,0 +1,23 @@
+package lanpair
+
+import "testing"
+
+func TestBuildAnnouncement(t *testing.T) {
+	pkt, err := buildAnnouncement(12345, []string{"192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkt) < 12 {
+		t.Fatalf("expected at least a DNS header, got %d bytes", len(pkt))
+	}
+	ancount := int(pkt[6])<<8 | int(pkt[7])
+	if ancount != 3 {
+		t.Fatalf("expected 3 answers (PTR, SRV, A), got %d", ancount)
+	}
+}
+
+func TestBuildAnnouncementNoAddresses(t *testing.T) {
+	if _, err := buildAnnouncement(12345, nil); err == nil {
+		t.Fatal("expected building an announcement with no addresses to fail")
+	}
+}